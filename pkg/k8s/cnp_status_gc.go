@@ -0,0 +1,207 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	cilium_v2 "github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+	clientset "github.com/cilium/cilium/pkg/k8s/client/clientset/versioned"
+	k8sversion "github.com/cilium/cilium/pkg/k8s/version"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultCNPStatusGCInterval is the default GC interval for a CNPStatusGC.
+// NewCNPStatusGC does not read it; callers pass it in when no other
+// interval is configured.
+const DefaultCNPStatusGCInterval = 5 * time.Minute
+
+// cnpStatusGCRemovedTotal counts the per-node CNPStatus entries removed by
+// CNPStatusGC, labelled by where they were removed from.
+var cnpStatusGCRemovedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cilium_operator",
+	Subsystem: "cnp_status_gc",
+	Name:      "removed_total",
+	Help:      "Number of stale per-node CNPStatus entries removed",
+}, []string{"source"})
+
+func init() {
+	metrics.MustRegister(cnpStatusGCRemovedTotal)
+}
+
+// LiveNodesFunc returns the set of node names currently considered part of
+// the cluster, e.g. backed by the CiliumNode informer's store. CNPStatusGC
+// treats any node not in this set as gone.
+type LiveNodesFunc func() map[string]struct{}
+
+// CNPStatusGC reconciles three sources of truth against one another: the
+// set of live nodes, the set of CNPStatusesPath/<namespace>/<name>/<nodeName>
+// keys present in the kvstore, and the status.nodes map embedded in each
+// CiliumNetworkPolicy. Entries whose node is no longer live, or whose
+// parent CNP no longer exists, are removed from both the kvstore and the
+// CNP object, preventing status.nodes from growing unbounded in long-lived
+// clusters.
+type CNPStatusGC struct {
+	client     clientset.Interface
+	liveNodes  LiveNodesFunc
+	gcInterval time.Duration
+}
+
+// NewCNPStatusGC creates a CNPStatusGC which removes stale per-node status
+// entries via client every gcInterval, using liveNodes to determine which
+// nodes are still part of the cluster.
+func NewCNPStatusGC(client clientset.Interface, liveNodes LiveNodesFunc, gcInterval time.Duration) *CNPStatusGC {
+	return &CNPStatusGC{
+		client:     client,
+		liveNodes:  liveNodes,
+		gcInterval: gcInterval,
+	}
+}
+
+// Run periodically garbage collects stale CNPStatus entries until ctx is
+// cancelled.
+func (gc *CNPStatusGC) Run(ctx context.Context) {
+	ticker := time.NewTicker(gc.gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := gc.runOnce(); err != nil {
+				log.WithError(err).Warning("CNPStatus garbage collection failed, will retry on next interval")
+			}
+		}
+	}
+}
+
+// runOnce performs a single GC pass.
+func (gc *CNPStatusGC) runOnce() error {
+	liveNodes := gc.liveNodes()
+
+	cnps, err := gc.client.CiliumV2().CiliumNetworkPolicies(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	liveCNPs := make(map[cnpKey]struct{}, len(cnps.Items))
+	for _, cnp := range cnps.Items {
+		liveCNPs[cnpKey{namespace: cnp.Namespace, name: cnp.Name}] = struct{}{}
+	}
+
+	pairs, err := kvstore.ListPrefix(CNPStatusesPath)
+	if err != nil {
+		return err
+	}
+
+	for key := range pairs {
+		gc.reconcileKey(key, liveCNPs, liveNodes)
+	}
+
+	// A node's CNPStatusesPath kvstore key is published with a lease, so it
+	// already expires on its own once the node is gone; reconcileKey above
+	// only catches entries whose kvstore key is still present. Walk every
+	// live CNP's own status.nodes map too, so a node that already expired
+	// out of the kvstore before this GC pass ran is still cleaned up there.
+	for _, cnp := range cnps.Items {
+		gc.reconcileCNPStatusNodes(cnp, liveNodes)
+	}
+
+	return nil
+}
+
+// reconcileCNPStatusNodes removes every node in cnp's status.nodes map that
+// is no longer in liveNodes, regardless of whether a CNPStatusesPath
+// kvstore key still exists for it.
+func (gc *CNPStatusGC) reconcileCNPStatusNodes(cnp cilium_v2.CiliumNetworkPolicy, liveNodes map[string]struct{}) {
+	for nodeName := range cnp.Status.Nodes {
+		if _, nodeLive := liveNodes[nodeName]; nodeLive {
+			continue
+		}
+
+		scopedLog := log.WithFields(logrus.Fields{
+			logfields.K8sNamespace:            cnp.Namespace,
+			logfields.CiliumNetworkPolicyName: cnp.Name,
+			logfields.NodeName:                nodeName,
+		})
+
+		if err := gc.removeNodeStatus(cnpKey{namespace: cnp.Namespace, name: cnp.Name}, nodeName); err != nil {
+			scopedLog.WithError(err).Warning("Failed to remove stale node entry from CNP status")
+			continue
+		}
+		cnpStatusGCRemovedTotal.WithLabelValues("cnp-status").Inc()
+	}
+}
+
+// reconcileKey removes a single CNPStatusesPath kvstore key, and the
+// corresponding entry in the CNP's status.nodes map, if its parent CNP no
+// longer exists or its node is no longer live.
+func (gc *CNPStatusGC) reconcileKey(key string, liveCNPs map[cnpKey]struct{}, liveNodes map[string]struct{}) {
+	relative := strings.TrimPrefix(strings.TrimPrefix(key, CNPStatusesPath), "/")
+	parts := strings.SplitN(relative, "/", 3)
+	if len(parts) != 3 {
+		return
+	}
+
+	ck := cnpKey{namespace: parts[0], name: parts[1]}
+	nodeName := parts[2]
+
+	_, cnpExists := liveCNPs[ck]
+	_, nodeLive := liveNodes[nodeName]
+	if cnpExists && nodeLive {
+		return
+	}
+
+	scopedLog := log.WithFields(logrus.Fields{
+		logfields.K8sNamespace:            ck.namespace,
+		logfields.CiliumNetworkPolicyName: ck.name,
+		logfields.NodeName:                nodeName,
+	})
+
+	if err := kvstore.Delete(key); err != nil {
+		scopedLog.WithError(err).Warning("Failed to remove stale CNPStatus key from kvstore")
+		return
+	}
+	cnpStatusGCRemovedTotal.WithLabelValues("kvstore").Inc()
+
+	if !cnpExists {
+		// The parent CNP is gone entirely; there's nothing left in k8s to
+		// patch.
+		return
+	}
+
+	if err := gc.removeNodeStatus(ck, nodeName); err != nil {
+		scopedLog.WithError(err).Warning("Failed to remove stale node entry from CNP status")
+		return
+	}
+	cnpStatusGCRemovedTotal.WithLabelValues("cnp-status").Inc()
+}
+
+// removeNodeStatus removes nodeName from the CNP's status.nodes map, using
+// the same capability-aware patching logic as UpdateStatusesByCapabilities
+// (shared with CNPStatusEventHandler's flush-on-delete path) so it also
+// works on k8s < 1.13.
+func (gc *CNPStatusGC) removeNodeStatus(key cnpKey, nodeName string) error {
+	return removeCNPStatusNode(gc.client, k8sversion.Capabilities(), key.namespace, key.name, nodeName)
+}
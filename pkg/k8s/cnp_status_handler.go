@@ -0,0 +1,342 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cilium/cilium/pkg/backoff"
+	cilium_v2 "github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+	clientset "github.com/cilium/cilium/pkg/k8s/client/clientset/versioned"
+	k8sversion "github.com/cilium/cilium/pkg/k8s/version"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+
+	"github.com/sirupsen/logrus"
+	k8sTypes "k8s.io/apimachinery/pkg/types"
+)
+
+// DefaultCNPStatusUpdateInterval is the default flush interval for a
+// CNPStatusEventHandler. NewCNPStatusEventHandler does not read it; callers
+// pass it in when no other interval is configured.
+const DefaultCNPStatusUpdateInterval = 10 * time.Second
+
+// cnpStatusFlushRetries bounds how many attempts in all, with exponential
+// backoff between them, a single flush of a CNP's aggregated node statuses
+// makes before being left for the next periodic tick.
+const cnpStatusFlushRetries = 5
+
+// cnpKey identifies the CiliumNetworkPolicy a CiliumNetworkPolicyNodeStatus
+// belongs to.
+type cnpKey struct {
+	namespace string
+	name      string
+}
+
+// CNPStatusKey is the kvstore shared-store key/value pair used to publish a
+// single node's view of a CNP's status. Its kvstore key is
+// "<namespace>/<name>/<nodeName>" under CNPStatusesPath.
+type CNPStatusKey struct {
+	Namespace string
+	Name      string
+	NodeName  string
+	Status    cilium_v2.CiliumNetworkPolicyNodeStatus
+}
+
+// GetKeyName implements store.Key.
+func (k *CNPStatusKey) GetKeyName() string {
+	return path.Join(k.Namespace, k.Name, k.NodeName)
+}
+
+// Marshal implements store.Key.
+func (k *CNPStatusKey) Marshal() ([]byte, error) {
+	return json.Marshal(k.Status)
+}
+
+// Unmarshal implements store.Key.
+func (k *CNPStatusKey) Unmarshal(key string, data []byte) error {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("unexpected CNPStatus kvstore key %q, expected <namespace>/<name>/<nodeName>", key)
+	}
+
+	k.Namespace, k.Name, k.NodeName = parts[0], parts[1], parts[2]
+	return json.Unmarshal(data, &k.Status)
+}
+
+// CNPStatusEventHandler aggregates the per-node CNPStatus values that
+// agents publish to CNPStatusesPath in the kvstore (see
+// CNPStatusUpdateContext.updateViaKvstore) into an in-memory map keyed by
+// (namespace, name), and periodically flushes each CNP's full set of node
+// statuses back into k8s as a single JSON Patch via
+// UpdateStatusesByCapabilities. This moves the N-node status fan-out off
+// the kube-apiserver and onto the cilium-operator.
+type CNPStatusEventHandler struct {
+	client        clientset.Interface
+	flushInterval time.Duration
+
+	mutex    lock.Mutex
+	statuses map[cnpKey]map[string]cilium_v2.CiliumNetworkPolicyNodeStatus
+	removals map[cnpKey]map[string]struct{}
+	dirty    map[cnpKey]struct{}
+}
+
+// NewCNPStatusEventHandler creates a CNPStatusEventHandler which flushes
+// aggregated statuses through client every flushInterval.
+//
+// The caller is responsible for constructing h with an
+// --cnp-status-update-interval-derived flushInterval (falling back to
+// DefaultCNPStatusUpdateInterval), calling WatchCNPStatuses, and running
+// h.Run for the lifetime of the cilium-operator process; none of that
+// wiring lives in this package.
+func NewCNPStatusEventHandler(client clientset.Interface, flushInterval time.Duration) *CNPStatusEventHandler {
+	return &CNPStatusEventHandler{
+		client:        client,
+		flushInterval: flushInterval,
+		statuses:      map[cnpKey]map[string]cilium_v2.CiliumNetworkPolicyNodeStatus{},
+		removals:      map[cnpKey]map[string]struct{}{},
+		dirty:         map[cnpKey]struct{}{},
+	}
+}
+
+// WatchCNPStatuses joins the CNPStatusesPath shared store so that h starts
+// receiving OnUpdate/OnDelete callbacks for every node's published status.
+func (h *CNPStatusEventHandler) WatchCNPStatuses(ctx context.Context) (*store.SharedStore, error) {
+	return store.JoinSharedStore(store.Configuration{
+		Prefix:     CNPStatusesPath,
+		KeyCreator: func() store.Key { return &CNPStatusKey{} },
+		Observer:   h,
+		Context:    ctx,
+	})
+}
+
+// OnUpdate implements store.Observer. It is called by the shared store for
+// every CNPStatusKey created or updated in the kvstore.
+func (h *CNPStatusEventHandler) OnUpdate(k store.Key) {
+	statusKey, ok := k.(*CNPStatusKey)
+	if !ok {
+		return
+	}
+
+	key := cnpKey{namespace: statusKey.Namespace, name: statusKey.Name}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	nodeStatuses, ok := h.statuses[key]
+	if !ok {
+		nodeStatuses = map[string]cilium_v2.CiliumNetworkPolicyNodeStatus{}
+		h.statuses[key] = nodeStatuses
+	}
+	nodeStatuses[statusKey.NodeName] = statusKey.Status
+	h.dirty[key] = struct{}{}
+}
+
+// OnDelete implements store.Observer. It is called when a node's
+// CNPStatusKey is removed from the kvstore, e.g. because the node or the
+// CNP it belonged to was deleted. In addition to dropping the node from
+// the in-memory aggregate, it records the removal so the next flush issues
+// an actual "remove" patch against the live CNP instead of just no longer
+// resending that node's last known status.
+func (h *CNPStatusEventHandler) OnDelete(k store.NamedKey) {
+	parts := strings.SplitN(k.GetKeyName(), "/", 3)
+	if len(parts) != 3 {
+		return
+	}
+	key := cnpKey{namespace: parts[0], name: parts[1]}
+	nodeName := parts[2]
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if nodeStatuses, ok := h.statuses[key]; ok {
+		delete(nodeStatuses, nodeName)
+	}
+
+	removedNodes, ok := h.removals[key]
+	if !ok {
+		removedNodes = map[string]struct{}{}
+		h.removals[key] = removedNodes
+	}
+	removedNodes[nodeName] = struct{}{}
+
+	h.dirty[key] = struct{}{}
+}
+
+// Run periodically flushes every CNP with pending status updates until ctx
+// is cancelled.
+func (h *CNPStatusEventHandler) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.flushAll(ctx)
+		}
+	}
+}
+
+// dirtyKeys returns the set of CNPs with status updates pending a flush.
+func (h *CNPStatusEventHandler) dirtyKeys() []cnpKey {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	keys := make([]cnpKey, 0, len(h.dirty))
+	for key := range h.dirty {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// flushAll flushes every CNP which has accumulated status updates since the
+// last flush.
+func (h *CNPStatusEventHandler) flushAll(ctx context.Context) {
+	for _, key := range h.dirtyKeys() {
+		if err := h.flush(ctx, key); err != nil {
+			log.WithError(err).WithFields(logrus.Fields{
+				logfields.K8sNamespace:            key.namespace,
+				logfields.CiliumNetworkPolicyName: key.name,
+			}).Warning("Failed to flush aggregated CNPStatus, will retry on next interval")
+			continue
+		}
+
+		h.mutex.Lock()
+		delete(h.dirty, key)
+		h.mutex.Unlock()
+	}
+}
+
+// flush batches the current set of node statuses known for key into a
+// single JSON Patch against the real CNP object (chunked internally by
+// UpdateStatusesByCapabilities according to MaxJSONPatchOperations), then
+// issues an explicit removal patch for every node deleted from the
+// kvstore since the last flush, retrying transient API errors with
+// backoff. It returns the first error encountered, leaving any remaining
+// work for the next tick.
+func (h *CNPStatusEventHandler) flush(ctx context.Context, key cnpKey) error {
+	h.mutex.Lock()
+	nodeStatuses := make(map[string]cilium_v2.CiliumNetworkPolicyNodeStatus, len(h.statuses[key]))
+	for nodeName, status := range h.statuses[key] {
+		nodeStatuses[nodeName] = status
+	}
+	removals := make([]string, 0, len(h.removals[key]))
+	for nodeName := range h.removals[key] {
+		removals = append(removals, nodeName)
+	}
+	h.mutex.Unlock()
+
+	capabilities := k8sversion.Capabilities()
+
+	if len(nodeStatuses) > 0 {
+		if err := h.flushUpdates(ctx, capabilities, key, nodeStatuses); err != nil {
+			return err
+		}
+	}
+
+	for _, nodeName := range removals {
+		if err := h.flushRemoval(ctx, capabilities, key, nodeName); err != nil {
+			return err
+		}
+
+		h.mutex.Lock()
+		if removedNodes, ok := h.removals[key]; ok {
+			delete(removedNodes, nodeName)
+			if len(removedNodes) == 0 {
+				delete(h.removals, key)
+			}
+		}
+		h.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// flushUpdates pushes the aggregated nodeStatuses for key to k8s.
+func (h *CNPStatusEventHandler) flushUpdates(ctx context.Context, capabilities k8sversion.ServerCapabilities, key cnpKey, nodeStatuses map[string]cilium_v2.CiliumNetworkPolicyNodeStatus) error {
+	return h.withRetries(ctx, func() error {
+		return UpdateStatusesByCapabilities(capabilities, key.namespace, key.name, nodeStatuses, h.client, nil)
+	})
+}
+
+// flushRemoval removes nodeName from key's status.nodes in k8s.
+func (h *CNPStatusEventHandler) flushRemoval(ctx context.Context, capabilities k8sversion.ServerCapabilities, key cnpKey, nodeName string) error {
+	return h.withRetries(ctx, func() error {
+		return removeCNPStatusNode(h.client, capabilities, key.namespace, key.name, nodeName)
+	})
+}
+
+// withRetries calls fn up to cnpStatusFlushRetries times in all, with
+// exponential backoff between attempts, until it succeeds.
+func (h *CNPStatusEventHandler) withRetries(ctx context.Context, fn func() error) error {
+	var err error
+	retryBackoff := backoff.Exponential{Min: time.Second}
+	for attempt := 1; attempt <= cnpStatusFlushRetries; attempt++ {
+		err = fn()
+		if err == nil || attempt == cnpStatusFlushRetries {
+			break
+		}
+		retryBackoff.Wait(ctx)
+	}
+	return err
+}
+
+// removeCNPStatusNode removes nodeName from the (ns, name) CNP's
+// status.nodes map, using the same capability-aware patching logic as
+// UpdateStatusesByCapabilities so it also works on k8s < 1.13.
+func removeCNPStatusNode(client clientset.Interface, capabilities k8sversion.ServerCapabilities, ns, name, nodeName string) error {
+	switch {
+	case capabilities.Patch:
+		removeNodePatch := []JSONPatch{
+			{
+				OP:   "remove",
+				Path: "/status/nodes/" + nodeName,
+			},
+		}
+
+		patchJSON, err := json.Marshal(removeNodePatch)
+		if err != nil {
+			return err
+		}
+
+		_, err = client.CiliumV2().CiliumNetworkPolicies(ns).
+			Patch(name, k8sTypes.JSONPatchType, patchJSON, "status")
+		return err
+	case capabilities.UpdateStatus:
+		cnp, err := getSlimCNP(client, ns, name)
+		if err != nil {
+			return err
+		}
+		delete(cnp.Status.Nodes, nodeName)
+		_, err = client.CiliumV2().CiliumNetworkPolicies(ns).UpdateStatus(cnp.CiliumNetworkPolicy)
+		return err
+	default:
+		cnp, err := getSlimCNP(client, ns, name)
+		if err != nil {
+			return err
+		}
+		delete(cnp.Status.Nodes, nodeName)
+		_, err = client.CiliumV2().CiliumNetworkPolicies(ns).Update(cnp.CiliumNetworkPolicy)
+		return err
+	}
+}
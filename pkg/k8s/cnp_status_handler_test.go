@@ -0,0 +1,173 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cilium_v2 "github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+	"github.com/cilium/cilium/pkg/k8s/client/clientset/versioned/fake"
+	k8sversion "github.com/cilium/cilium/pkg/k8s/version"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOnUpdateCoalescesNodes(t *testing.T) {
+	h := NewCNPStatusEventHandler(nil, DefaultCNPStatusUpdateInterval)
+	key := cnpKey{namespace: "default", name: "cnp"}
+
+	h.OnUpdate(&CNPStatusKey{Namespace: "default", Name: "cnp", NodeName: "node1", Status: cilium_v2.CiliumNetworkPolicyNodeStatus{OK: true}})
+	h.OnUpdate(&CNPStatusKey{Namespace: "default", Name: "cnp", NodeName: "node2", Status: cilium_v2.CiliumNetworkPolicyNodeStatus{OK: true}})
+	if len(h.statuses[key]) != 2 {
+		t.Fatalf("expected 2 aggregated node statuses, got %d", len(h.statuses[key]))
+	}
+
+	// A second update for the same node coalesces rather than duplicating.
+	h.OnUpdate(&CNPStatusKey{Namespace: "default", Name: "cnp", NodeName: "node1", Status: cilium_v2.CiliumNetworkPolicyNodeStatus{OK: false}})
+	if len(h.statuses[key]) != 2 {
+		t.Fatalf("expected coalesced update to keep 2 node statuses, got %d", len(h.statuses[key]))
+	}
+	if h.statuses[key]["node1"].OK {
+		t.Fatalf("expected node1's status to be overwritten by the later update")
+	}
+	if len(h.dirty) != 1 {
+		t.Fatalf("expected 1 dirty CNP, got %d", len(h.dirty))
+	}
+}
+
+func TestOnDeleteTracksRemoval(t *testing.T) {
+	h := NewCNPStatusEventHandler(nil, DefaultCNPStatusUpdateInterval)
+	key := cnpKey{namespace: "default", name: "cnp"}
+
+	h.OnUpdate(&CNPStatusKey{Namespace: "default", Name: "cnp", NodeName: "node1", Status: cilium_v2.CiliumNetworkPolicyNodeStatus{OK: true}})
+	delete(h.dirty, key)
+
+	h.OnDelete(&CNPStatusKey{Namespace: "default", Name: "cnp", NodeName: "node1"})
+
+	if len(h.statuses[key]) != 0 {
+		t.Fatalf("expected node1 to be dropped from the aggregate, got %d entries", len(h.statuses[key]))
+	}
+	if _, removed := h.removals[key]["node1"]; !removed {
+		t.Fatalf("expected node1 to be tracked as a pending removal")
+	}
+	if len(h.dirty) != 1 {
+		t.Fatalf("expected OnDelete to mark the CNP dirty so the removal is flushed")
+	}
+}
+
+func TestWithRetriesBackoffOnTransientErrors(t *testing.T) {
+	h := NewCNPStatusEventHandler(nil, DefaultCNPStatusUpdateInterval)
+
+	attempts := 0
+	err := h.withRetries(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected eventual success, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+// TestFlushIssuesRealRemovalPatch exercises flush's removal path end to
+// end against a fake clientset, so that a node deleted from the kvstore is
+// verified to actually disappear from the live CNP's status.nodes, not
+// just from the handler's own bookkeeping.
+func TestFlushIssuesRealRemovalPatch(t *testing.T) {
+	cnp := &cilium_v2.CiliumNetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "derived", Namespace: "default"},
+		Status: cilium_v2.CiliumNetworkPolicyStatus{
+			Nodes: map[string]cilium_v2.CiliumNetworkPolicyNodeStatus{
+				"node1": {OK: true},
+				"node2": {OK: true},
+			},
+		},
+	}
+	client := fake.NewSimpleClientset(cnp)
+
+	h := NewCNPStatusEventHandler(client, DefaultCNPStatusUpdateInterval)
+	key := cnpKey{namespace: "default", name: "derived"}
+	h.removals[key] = map[string]struct{}{"node1": {}}
+
+	if err := h.flush(context.Background(), key); err != nil {
+		t.Fatalf("flush returned an unexpected error: %v", err)
+	}
+
+	got, err := client.CiliumV2().CiliumNetworkPolicies("default").Get("derived", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch the CNP back: %v", err)
+	}
+	if _, stillThere := got.Status.Nodes["node1"]; stillThere {
+		t.Fatalf("expected node1 to be removed from status.nodes by flush")
+	}
+	if _, stillThere := got.Status.Nodes["node2"]; !stillThere {
+		t.Fatalf("expected node2 to be left untouched")
+	}
+	if _, pending := h.removals[key]; pending {
+		t.Fatalf("expected the removal to be cleared from h.removals once flushed")
+	}
+}
+
+// TestRemoveCNPStatusNodeViaJSONPatch covers the Patch-capable branch that
+// flush's removal path falls into on clusters new enough to support it,
+// which TestFlushIssuesRealRemovalPatch's zero-value capabilities don't
+// exercise.
+func TestRemoveCNPStatusNodeViaJSONPatch(t *testing.T) {
+	cnp := &cilium_v2.CiliumNetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "derived", Namespace: "default"},
+		Status: cilium_v2.CiliumNetworkPolicyStatus{
+			Nodes: map[string]cilium_v2.CiliumNetworkPolicyNodeStatus{
+				"node1": {OK: true},
+			},
+		},
+	}
+	client := fake.NewSimpleClientset(cnp)
+
+	err := removeCNPStatusNode(client, k8sversion.ServerCapabilities{Patch: true}, "default", "derived", "node1")
+	if err != nil {
+		t.Fatalf("removeCNPStatusNode returned an unexpected error: %v", err)
+	}
+
+	got, err := client.CiliumV2().CiliumNetworkPolicies("default").Get("derived", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to fetch the CNP back: %v", err)
+	}
+	if _, stillThere := got.Status.Nodes["node1"]; stillThere {
+		t.Fatalf("expected node1 to be removed from status.nodes by the JSON patch")
+	}
+}
+
+func TestWithRetriesGivesUpAfterCnpStatusFlushRetries(t *testing.T) {
+	h := NewCNPStatusEventHandler(nil, DefaultCNPStatusUpdateInterval)
+
+	attempts := 0
+	err := h.withRetries(context.Background(), func() error {
+		attempts++
+		return errors.New("permanent")
+	})
+	if err == nil {
+		t.Fatalf("expected the persistent error to be returned")
+	}
+	if attempts != cnpStatusFlushRetries {
+		t.Fatalf("expected %d attempts, got %d", cnpStatusFlushRetries, attempts)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2018-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package groups
+
+import (
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/policy/api"
+)
+
+// derivativeCache tracks, per parent CNP/CCNP UID, the most recently
+// generated set of derivative Specs. createDerivativeCNP consults it when
+// a ToGroups rule's resolution fails and the policy has opted into the
+// "last-known" PolicyEnforcementOnResolutionFailure mode, so a transient
+// cloud API error doesn't blackhole egress that was previously resolved
+// successfully.
+type derivativeCache struct {
+	mutex lock.Mutex
+	specs map[string]api.Rules
+}
+
+func newDerivativeCache() *derivativeCache {
+	return &derivativeCache{
+		specs: map[string]api.Rules{},
+	}
+}
+
+// Get returns the last-known-good Specs for parentUID, if any.
+func (c *derivativeCache) Get(parentUID string) (api.Rules, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	specs, ok := c.specs[parentUID]
+	return specs, ok
+}
+
+// Set records specs as the last-known-good Specs for parentUID.
+func (c *derivativeCache) Set(parentUID string, specs api.Rules) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.specs[parentUID] = specs
+}
+
+// Delete drops any cached Specs for parentUID, e.g. because the parent
+// CNP/CCNP was deleted.
+func (c *derivativeCache) Delete(parentUID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.specs, parentUID)
+}
+
+// groupsCNPCache is the package-wide last-known-good Specs cache.
+var groupsCNPCache = newDerivativeCache()
@@ -0,0 +1,156 @@
+// Copyright 2018-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package groups
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	cilium_v2 "github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+	"github.com/cilium/cilium/pkg/controller"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/metrics"
+)
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "policy-groups")
+
+// DefaultDerivativeRefreshInterval is the refresh interval
+// EnsureDerivativeController uses unless overridden via
+// SetDerivativeRefreshInterval.
+const DefaultDerivativeRefreshInterval = 5 * time.Minute
+
+var derivativeRefreshInterval = DefaultDerivativeRefreshInterval
+
+// SetDerivativeRefreshInterval overrides the interval at which every
+// derivative controller re-resolves its parent's ToGroups rules, for
+// controllers started after the call. It is intended to be wired to an
+// agent/operator flag by the caller.
+func SetDerivativeRefreshInterval(d time.Duration) {
+	derivativeRefreshInterval = d
+}
+
+// groupsControllerManager supervises one controller per parent CNP/CCNP.
+// Each controller periodically re-resolves that parent's ToGroups
+// derivatives even without a CNP watcher event, so cloud group membership
+// changes (e.g. an AWS security-group gaining or losing an instance) are
+// picked up on a steady cadence instead of only on CNP updates.
+var groupsControllerManager = controller.NewManager()
+
+var (
+	activeControllersMutex lock.Mutex
+	activeControllers      = map[string]struct{}{}
+)
+
+func derivativeControllerName(parentUID string) string {
+	return fmt.Sprintf("groups-derivative-%s", parentUID)
+}
+
+// EnsureDerivativeController starts, or refreshes, the managed controller
+// responsible for generating and publishing the derivative CNP/CCNP for
+// cnp. The controller reconciles on every CNP watcher event (by being
+// re-registered here) and additionally on a fixed derivativeRefreshInterval
+// cadence, so that group membership changes upstream are eventually picked
+// up even if the parent CNP itself never changes again.
+//
+// The caller is responsible for invoking this from the CNP/CCNP watcher's
+// add/update handler in place of a one-shot createDerivativeCNP call, for
+// calling StopDerivativeController from the corresponding delete handler,
+// and for routing a refresh-interval flag into SetDerivativeRefreshInterval;
+// none of that watcher wiring lives in this package.
+func EnsureDerivativeController(cnp *cilium_v2.CiliumNetworkPolicy, ccnpDerived bool) {
+	parentUID := string(cnp.ObjectMeta.UID)
+	name := derivativeControllerName(parentUID)
+
+	groupsControllerManager.UpdateController(name, controller.ControllerParams{
+		RunInterval: derivativeRefreshInterval,
+		DoFunc: func(ctx context.Context) error {
+			return reconcileDerivativeCNP(ctx, cnp, ccnpDerived)
+		},
+	})
+
+	activeControllersMutex.Lock()
+	activeControllers[parentUID] = struct{}{}
+	DerivativePolicies.Set(float64(len(activeControllers)))
+	activeControllersMutex.Unlock()
+}
+
+// StopDerivativeController stops and removes the periodic controller for
+// a parent CNP, e.g. because the parent itself was deleted.
+func StopDerivativeController(parentUID string) {
+	groupsControllerManager.RemoveController(derivativeControllerName(parentUID))
+	groupsCNPCache.Delete(parentUID)
+
+	activeControllersMutex.Lock()
+	delete(activeControllers, parentUID)
+	DerivativePolicies.Set(float64(len(activeControllers)))
+	activeControllersMutex.Unlock()
+}
+
+// reconcileDerivativeCNP regenerates the derivative CNP/CCNP for cnp,
+// pushes it to k8s, and reports the outcome both as a CNP status and as
+// Prometheus metrics. It is the DoFunc run by the managed controller
+// registered in EnsureDerivativeController.
+//
+// createDerivativeCNP still returns a *ResolutionFailedError alongside a
+// usable derivativeCNP when it fell back to last-known-good or
+// partially-resolved Specs, so the push below must not be skipped in that
+// case: doing so would silently discard the very Specs onResolutionFailureMode
+// computed to avoid blackholing egress.
+func reconcileDerivativeCNP(ctx context.Context, cnp *cilium_v2.CiliumNetworkPolicy, ccnpDerived bool) error {
+	start := time.Now()
+
+	derivativeCNP, resolveErr := createDerivativeCNP(ctx, cnp, ccnpDerived)
+
+	outcome := metrics.LabelValueOutcomeSuccess
+	if resolveErr != nil {
+		outcome = metrics.LabelValueOutcomeFail
+		ResolutionErrors.WithLabelValues(outcome).Inc()
+	}
+	ResolutionDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+
+	var resolutionFailedErr *ResolutionFailedError
+	pushable := resolveErr == nil || errors.As(resolveErr, &resolutionFailedErr)
+
+	var pushErr error
+	if pushable {
+		if ccnpDerived {
+			_, pushErr = updateOrCreateCCNP(derivativeCNP)
+		} else {
+			_, pushErr = updateOrCreateCNP(derivativeCNP)
+		}
+	}
+
+	// Report the resolution outcome, not the push outcome: a
+	// ResolutionFailedError is still the condition callers need to see and
+	// requeue on, even though its Specs were pushed.
+	err := resolveErr
+	if err == nil {
+		err = pushErr
+	}
+
+	if statusErr := updateDerivativeStatus(cnp, derivativeCNP.ObjectMeta.Name, err, !ccnpDerived); statusErr != nil {
+		log.WithError(statusErr).WithField(logfields.CiliumNetworkPolicyName, cnp.ObjectMeta.Name).
+			Debug("cannot update derivative policy status")
+	}
+
+	if pushErr != nil {
+		return pushErr
+	}
+	return resolveErr
+}
@@ -16,13 +16,20 @@ package groups
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"path"
 
 	"github.com/cilium/cilium/pkg/k8s"
 	cilium_v2 "github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
 	slimv1 "github.com/cilium/cilium/pkg/k8s/slim/k8s/apis/meta/v1"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/node"
+	"github.com/cilium/cilium/pkg/option"
 	"github.com/cilium/cilium/pkg/policy/api"
 
+	k8sTypes "k8s.io/apimachinery/pkg/types"
+
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -95,33 +102,114 @@ func createDerivativeCNP(ctx context.Context, cnp *cilium_v2.CiliumNetworkPolicy
 		return derivativeCNP, fmt.Errorf("cannot parse policies: %v", err)
 	}
 
-	derivativeCNP.Specs = make(api.Rules, len(rules))
+	parentUID := string(cnp.ObjectMeta.UID)
+	onFailure := onResolutionFailureMode(cnp)
+
+	// Build the derivative Specs in a single pass into a staging slice.
+	// Each rule that fails to resolve is staged as a deny-egress rule, or as
+	// an allow-egress rule in "allow" mode. derivativeCNP.Specs is set only
+	// after the whole pass; in "last-known" mode a failure returns the cached
+	// Specs instead of the staged ones when a cache entry exists. The cache
+	// is updated only when every rule resolved.
+	staged := make(api.Rules, len(rules))
+	var resolveErr error
 	for i, rule := range rules {
-		if rule.RequiresDerivative() {
-			derivativeCNP.Specs[i] = denyEgressRule()
+		if !rule.RequiresDerivative() {
+			staged[i] = rule
+			continue
 		}
-	}
 
-	for i, rule := range rules {
-		if !rule.RequiresDerivative() {
-			derivativeCNP.Specs[i] = rule
+		newRule, err := defaultResolver.Resolve(ctx, rule)
+		if err == nil {
+			staged[i] = newRule
 			continue
 		}
-		newRule, err := rule.CreateDerivative(ctx)
-		if err != nil {
-			return derivativeCNP, err
+
+		resolveErr = err
+		if onFailure == onResolutionFailureAllow {
+			staged[i] = allowEgressRule()
+		} else {
+			staged[i] = denyEgressRule()
 		}
-		derivativeCNP.Specs[i] = newRule
 	}
+
+	if resolveErr != nil {
+		if onFailure == onResolutionFailureLastKnown {
+			if lastGood, ok := groupsCNPCache.Get(parentUID); ok {
+				derivativeCNP.Specs = lastGood
+				return derivativeCNP, &ResolutionFailedError{err: resolveErr}
+			}
+		}
+		derivativeCNP.Specs = staged
+		return derivativeCNP, &ResolutionFailedError{err: resolveErr}
+	}
+
+	derivativeCNP.Specs = staged
+	groupsCNPCache.Set(parentUID, staged)
 	return derivativeCNP, nil
 }
 
+const (
+	// onResolutionFailureAnnotation lets users pick how a derivative
+	// CNP/CCNP behaves when one of its ToGroups rules fails to resolve
+	// (e.g. a transient cloud API error), instead of always getting an
+	// implicit deny.
+	onResolutionFailureAnnotation = "io.cilium.network.policy.on-failure"
+
+	onResolutionFailureDeny      = "deny"
+	onResolutionFailureAllow     = "allow"
+	onResolutionFailureLastKnown = "last-known"
+)
+
+// onResolutionFailureMode returns the fail-mode requested via
+// onResolutionFailureAnnotation on cnp, defaulting to "deny" to preserve
+// the historical behavior for policies that don't opt in.
+func onResolutionFailureMode(cnp *cilium_v2.CiliumNetworkPolicy) string {
+	switch cnp.ObjectMeta.Annotations[onResolutionFailureAnnotation] {
+	case onResolutionFailureAllow:
+		return onResolutionFailureAllow
+	case onResolutionFailureLastKnown:
+		return onResolutionFailureLastKnown
+	default:
+		return onResolutionFailureDeny
+	}
+}
+
+// ResolutionFailedError wraps an error returned by the Resolver. It is
+// returned together with the fallback Specs, whether these are the
+// last-known-good Specs or the staged ones, so that callers
+// of createDerivativeCNP can report it as a distinct status condition and
+// requeue, rather than treating it like a parse error.
+type ResolutionFailedError struct {
+	err error
+}
+
+func (e *ResolutionFailedError) Error() string {
+	return fmt.Sprintf("ResolutionFailed: %s", e.err)
+}
+
+func (e *ResolutionFailedError) Unwrap() error {
+	return e.err
+}
+
 func denyEgressRule() *api.Rule {
 	return &api.Rule{
 		Egress: []api.EgressRule{},
 	}
 }
 
+// allowEgressRule returns a rule that leaves egress unrestricted. It is
+// used in place of denyEgressRule() for the rules of a policy carrying the
+// "io.cilium.network.policy.on-failure: allow" annotation, so that a
+// transient resolution error opens egress rather than blackholing it.
+func allowEgressRule() *api.Rule {
+	return &api.Rule{
+		Egress: []api.EgressRule{
+			{ToEntities: []api.Entity{api.EntityAll}},
+		},
+	}
+}
+
 func updateOrCreateCNP(cnp *cilium_v2.CiliumNetworkPolicy) (*cilium_v2.CiliumNetworkPolicy, error) {
 	k8sCNP, err := k8s.CiliumClient().CiliumV2().CiliumNetworkPolicies(cnp.ObjectMeta.Namespace).
 		Get(context.TODO(), cnp.ObjectMeta.Name, v1.GetOptions{})
@@ -176,67 +264,91 @@ func updateDerivativeStatus(cnp *cilium_v2.CiliumNetworkPolicy, derivativeName s
 	return updateDerivativeCCNPStatus(cnp, status, derivativeName)
 }
 
+// derivativeStatusPatch builds the JSON Patch [RFC 6902] document used to
+// set the status of a single node for a derivative policy, without having
+// to Get + resend the full object.
+func derivativeStatusPatch(nodeName string, status cilium_v2.CiliumNetworkPolicyNodeStatus) ([]byte, error) {
+	return json.Marshal([]k8s.JSONPatch{
+		{
+			OP:    "replace",
+			Path:  "/status/nodes/" + nodeName,
+			Value: status,
+		},
+	})
+}
+
 func updateDerivativeCNPStatus(cnp *cilium_v2.CiliumNetworkPolicy, status cilium_v2.CiliumNetworkPolicyNodeStatus,
 	derivativeName string) error {
-	// This CNP can be modified by cilium agent or operator. To be able to push
-	// the status correctly fetch the last version to avoid updates issues.
-	k8sCNP, clientErr := k8s.CiliumClient().CiliumV2().CiliumNetworkPolicies(cnp.ObjectMeta.Namespace).
-		Get(context.TODO(), cnp.ObjectMeta.Name, v1.GetOptions{})
-
-	if clientErr != nil {
-		return fmt.Errorf("cannot get Kubernetes policy: %v", clientErr)
+	// Only namespaced CNPs are handled by the cilium-operator's
+	// CNPStatusEventHandler, which aggregates k8s.CNPStatusKey entries
+	// keyed by (namespace, name, nodeName) under k8s.CNPStatusesPath. CCNPs
+	// always go straight to k8s below.
+	if option.Config.K8sEventHandover {
+		return updateDerivativeStatusViaKvstore(cnp.ObjectMeta.Namespace, derivativeName, status)
 	}
 
-	if k8sCNP.ObjectMeta.UID != cnp.ObjectMeta.UID {
-		// This case should not happen, but if the UID does not match make sure
-		// that the new policy is not in the cache to not loop over it. The
-		// kubernetes watcher should take care about that.
-		groupsCNPCache.DeleteCNP(k8sCNP)
-		return fmt.Errorf("policy UID mistmatch")
+	patch, err := derivativeStatusPatch(node.GetName(), status)
+	if err != nil {
+		return fmt.Errorf("cannot marshal JSON patch for derivative CNP status: %v", err)
 	}
 
-	k8sCNP.SetDerivedPolicyStatus(derivativeName, status)
-	groupsCNPCache.UpdateCNP(k8sCNP)
-
-	// TODO: Switch to JSON patch.
-	_, err := k8s.CiliumClient().CiliumV2().CiliumNetworkPolicies(cnp.ObjectMeta.Namespace).
-		UpdateStatus(context.TODO(), k8sCNP, v1.UpdateOptions{})
+	_, err = k8s.CiliumClient().CiliumV2().CiliumNetworkPolicies(cnp.ObjectMeta.Namespace).
+		Patch(context.TODO(), derivativeName, k8sTypes.JSONPatchType, patch, v1.PatchOptions{}, "status")
+	if err != nil {
+		return fmt.Errorf("cannot update derivative CNP status: %v", err)
+	}
 
-	return err
+	return nil
 }
 
 func updateDerivativeCCNPStatus(cnp *cilium_v2.CiliumNetworkPolicy, status cilium_v2.CiliumNetworkPolicyNodeStatus,
 	derivativeName string) error {
-	k8sCCNP, clientErr := k8s.CiliumClient().CiliumV2().CiliumClusterwideNetworkPolicies().
-		Get(context.TODO(), cnp.ObjectMeta.Name, v1.GetOptions{})
+	// CNPStatusEventHandler only aggregates namespaced CiliumNetworkPolicy
+	// status (UpdateStatusesByCapabilities has no CCNP variant), so the
+	// kvstore handover path is not available here; always patch directly.
+	patch, err := derivativeStatusPatch(node.GetName(), status)
+	if err != nil {
+		return fmt.Errorf("cannot marshal JSON patch for derivative CCNP status: %v", err)
+	}
 
-	if clientErr != nil {
-		return fmt.Errorf("cannot get Kubernetes policy: %v", clientErr)
+	_, err = k8s.CiliumClient().CiliumV2().CiliumClusterwideNetworkPolicies().
+		Patch(context.TODO(), derivativeName, k8sTypes.JSONPatchType, patch, v1.PatchOptions{}, "status")
+	if err != nil {
+		return fmt.Errorf("cannot update derivative CCNP status: %v", err)
 	}
 
-	if k8sCCNP.ObjectMeta.UID != cnp.ObjectMeta.UID {
-		// This case should not happen, but if the UID does not match make sure
-		// that the new policy is not in the cache to not loop over it. The
-		// kubernetes watcher should take care of that.
-		groupsCNPCache.DeleteCNP(&cilium_v2.CiliumNetworkPolicy{
-			ObjectMeta: k8sCCNP.ObjectMeta,
-		})
-		return fmt.Errorf("policy UID mistmatch")
+	return nil
+}
+
+// updateDerivativeStatusViaKvstore publishes ns/name's per-node derivative
+// status to the kvstore instead of writing it to k8s directly, using the
+// same k8s.CNPStatusKey key schema (under k8s.CNPStatusesPath) that the
+// cilium-operator's k8s.CNPStatusEventHandler watches. The handler
+// aggregates the per-node values it observes for (ns, name) and coalesces
+// them into a single JSON Patch against the real CNP object, so every node
+// hitting the apiserver directly for the same derivative is avoided.
+func updateDerivativeStatusViaKvstore(ns, name string, status cilium_v2.CiliumNetworkPolicyNodeStatus) error {
+	ctx := context.TODO()
+
+	select {
+	case <-kvstore.Client().Connected():
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	k8sCCNP.SetDerivedPolicyStatus(derivativeName, status)
-	groupsCNPCache.UpdateCNP(&cilium_v2.CiliumNetworkPolicy{
-		TypeMeta:   k8sCCNP.TypeMeta,
-		ObjectMeta: k8sCCNP.ObjectMeta,
-		Spec:       k8sCCNP.Spec,
-		Specs:      k8sCCNP.Specs,
-		Status:     k8sCCNP.Status,
-	})
+	statusKey := &k8s.CNPStatusKey{
+		Namespace: ns,
+		Name:      name,
+		NodeName:  node.GetName(),
+		Status:    status,
+	}
 
-	// TODO: Switch to JSON patch
-	_, err := k8s.CiliumClient().CiliumV2().CiliumClusterwideNetworkPolicies().
-		UpdateStatus(context.TODO(), k8sCCNP, v1.UpdateOptions{})
+	marshaledVal, err := statusKey.Marshal()
+	if err != nil {
+		return err
+	}
 
+	key := path.Join(k8s.CNPStatusesPath, statusKey.GetKeyName())
+	_, err = kvstore.Client().UpdateIfDifferent(ctx, key, marshaledVal, true)
 	return err
-
 }
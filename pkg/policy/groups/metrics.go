@@ -0,0 +1,60 @@
+// Copyright 2018-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package groups
+
+import (
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "cilium_operator"
+	metricsSubsystem = "groups"
+)
+
+var (
+	// ResolutionDuration is the time taken to resolve a ToGroups rule's
+	// derivative, labelled by outcome.
+	ResolutionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "resolution_duration_seconds",
+		Help:      "Duration of resolving a ToGroups rule's derivative",
+	}, []string{metrics.LabelOutcome})
+
+	// ResolutionErrors counts failed ToGroups derivative resolutions.
+	ResolutionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "resolution_errors_total",
+		Help:      "Number of ToGroups derivative resolution failures",
+	}, []string{metrics.LabelOutcome})
+
+	// DerivativePolicies is the number of derivative CNPs/CCNPs currently
+	// under management by the periodic reconciliation controllers.
+	DerivativePolicies = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "derivative_policies",
+		Help:      "Number of derivative CNPs/CCNPs currently managed",
+	})
+)
+
+func init() {
+	metrics.MustRegister(ResolutionDuration)
+	metrics.MustRegister(ResolutionErrors)
+	metrics.MustRegister(DerivativePolicies)
+}
@@ -0,0 +1,263 @@
+// Copyright 2018-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package groups
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/cilium/cilium/pkg/backoff"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/policy/api"
+)
+
+const (
+	// resolverCacheTTL bounds how long a resolved derivative rule is
+	// considered fresh for a given group selector. CNPs referencing the
+	// same selector share this cache entry, so N CNPs resolving the same
+	// group produce a single upstream call per TTL window rather than N.
+	resolverCacheTTL = 5 * time.Minute
+
+	// resolverRateLimit and resolverRateBurst bound how often a single
+	// provider's CreateDerivative is invoked, to avoid hammering cloud
+	// APIs (e.g. AWS/GCP) when many CNPs reference groups from the same
+	// provider.
+	resolverRateLimit = rate.Limit(5)
+	resolverRateBurst = 1
+
+	// resolverMaxAttempts is the number of attempts in all, with
+	// exponential backoff between them, made for a transient resolution
+	// failure before it is surfaced to the caller.
+	resolverMaxAttempts = 3
+)
+
+// Resolver resolves the derivative of a ToGroups rule, e.g. by calling out
+// to a cloud provider to list the addresses currently behind a security
+// group or label selector.
+type Resolver interface {
+	// Resolve returns the derivative rule for the given parent rule.
+	Resolve(ctx context.Context, rule *api.Rule) (*api.Rule, error)
+}
+
+// ResolverFunc adapts a plain function to the Resolver interface.
+type ResolverFunc func(ctx context.Context, rule *api.Rule) (*api.Rule, error)
+
+// Resolve implements Resolver.
+func (f ResolverFunc) Resolve(ctx context.Context, rule *api.Rule) (*api.Rule, error) {
+	return f(ctx, rule)
+}
+
+// cacheEntry holds the last successfully resolved derivative for a given
+// canonical group selector.
+type cacheEntry struct {
+	rule     *api.Rule
+	resolved time.Time
+}
+
+// cachingResolver wraps a Resolver with a per-selector TTL cache and a
+// per-provider token-bucket rate limiter, and retries transient failures
+// with exponential backoff before giving up.
+type cachingResolver struct {
+	next Resolver
+
+	mutex    lock.Mutex
+	cache    map[string]cacheEntry
+	limiters map[string]*rate.Limiter
+}
+
+// providerResolvers holds Resolvers registered by individual providers
+// (AWS, GCP, ...) via RegisterProvider, keyed by the same provider name
+// providerKey derives from a rule's ToGroups selector. defaultResolver
+// consults this map before falling back to rule.CreateDerivative, so a
+// provider can supply its own Resolver (e.g. to reuse a single client
+// connection across rules) without changing how rules are cached or
+// rate-limited.
+var providerResolvers = map[string]Resolver{}
+
+// RegisterProvider registers resolver as the Resolver used for ToGroups
+// rules naming provider (e.g. "AWS", "GCP"), in place of the default
+// rule.CreateDerivative dispatch.
+func RegisterProvider(provider string, resolver Resolver) {
+	providerResolvers[provider] = resolver
+}
+
+// defaultResolver is the package-wide Resolver used by createDerivativeCNP.
+// It dispatches to a provider-registered Resolver if one exists for the
+// rule's ToGroups selector, falling back to rule.CreateDerivative (which
+// dispatches to whichever provider the rule names) otherwise.
+var defaultResolver Resolver = newCachingResolver(ResolverFunc(func(ctx context.Context, rule *api.Rule) (*api.Rule, error) {
+	if resolver, ok := providerResolvers[providerKey(rule)]; ok {
+		return resolver.Resolve(ctx, rule)
+	}
+	return rule.CreateDerivative(ctx)
+}))
+
+func newCachingResolver(next Resolver) *cachingResolver {
+	return &cachingResolver{
+		next:     next,
+		cache:    map[string]cacheEntry{},
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+// limiterForProvider returns the shared token-bucket limiter for provider,
+// creating it on first use. Keying by provider rather than by selector
+// means that N CNPs referencing N distinct selectors against the same
+// cloud provider (e.g. different AWS security-group IDs) all draw from a
+// single bucket, bounding aggregate load on that provider.
+func (c *cachingResolver) limiterForProvider(provider string) *rate.Limiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	limiter, ok := c.limiters[provider]
+	if !ok {
+		limiter = rate.NewLimiter(resolverRateLimit, resolverRateBurst)
+		c.limiters[provider] = limiter
+	}
+	return limiter
+}
+
+// Resolve implements Resolver.
+func (c *cachingResolver) Resolve(ctx context.Context, rule *api.Rule) (*api.Rule, error) {
+	key := canonicalSelectorKey(rule)
+
+	c.mutex.Lock()
+	entry, ok := c.cache[key]
+	c.mutex.Unlock()
+	if ok && time.Since(entry.resolved) < resolverCacheTTL {
+		return entry.rule, nil
+	}
+
+	if err := c.limiterForProvider(providerKey(rule)).Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	derivative, err := c.resolveWithRetries(ctx, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.cache[key] = cacheEntry{rule: derivative, resolved: time.Now()}
+	c.mutex.Unlock()
+
+	return derivative, nil
+}
+
+// resolveWithRetries calls the wrapped Resolver, retrying with exponential
+// backoff as long as the error looks transient (e.g. a cloud API timeout or
+// throttling response).
+func (c *cachingResolver) resolveWithRetries(ctx context.Context, rule *api.Rule) (*api.Rule, error) {
+	var (
+		derivative *api.Rule
+		err        error
+	)
+
+	retryBackoff := backoff.Exponential{Min: time.Second}
+	for attempt := 1; attempt <= resolverMaxAttempts; attempt++ {
+		derivative, err = c.next.Resolve(ctx, rule)
+		if err == nil || !isTransientResolveError(err) || attempt == resolverMaxAttempts {
+			break
+		}
+		retryBackoff.Wait(ctx)
+	}
+
+	return derivative, err
+}
+
+// canonicalSelectorKey returns a stable key identifying the group
+// selector(s) a rule actually resolves against, so that distinct CNPs
+// referencing the same group (e.g. the same AWS security-group ID) share a
+// cache entry regardless of what else differs between them (EndpointSelector,
+// Labels, unrelated Egress entries, ...). Rules without a ToGroups selector
+// never reach the cache (see api.Rule.RequiresDerivative), but rule.String()
+// is used as a fallback key just in case.
+func canonicalSelectorKey(rule *api.Rule) string {
+	var keys []string
+	for _, egress := range rule.Egress {
+		for _, groups := range egress.ToGroups {
+			keys = append(keys, groupsSelectorKey(groups))
+		}
+	}
+	if len(keys) == 0 {
+		return rule.String()
+	}
+	return strings.Join(keys, "|")
+}
+
+// providerKey returns the name of the cloud provider (e.g. "AWS", "GCP")
+// named by rule's first ToGroups selector, or "unknown" if none can be
+// determined.
+func providerKey(rule *api.Rule) string {
+	for _, egress := range rule.Egress {
+		for _, groups := range egress.ToGroups {
+			if name, _, ok := firstNonNilProviderField(groups); ok {
+				return name
+			}
+		}
+	}
+	return "unknown"
+}
+
+// groupsSelectorKey returns a key identifying a single ToGroups selector,
+// combining the provider name with the value of its selector so that two
+// identical selectors for the same provider (e.g. the same AWS
+// security-group ID) produce the same key.
+func groupsSelectorKey(groups api.Groups) string {
+	name, value, ok := firstNonNilProviderField(groups)
+	if !ok {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s:%+v", name, value.Elem().Interface())
+}
+
+// firstNonNilProviderField returns the name and value of the first non-nil
+// provider-specific pointer field in groups. api.Groups is a struct of
+// provider-specific pointer fields, only one of which is set per selector;
+// reflection lets this stay in sync with api.Groups as providers are added
+// without listing them here too.
+func firstNonNilProviderField(groups api.Groups) (string, reflect.Value, bool) {
+	v := reflect.ValueOf(groups)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Ptr && !field.IsNil() {
+			return v.Type().Field(i).Name, field, true
+		}
+	}
+	return "", reflect.Value{}, false
+}
+
+// isTransientResolveError reports whether err is likely to succeed on
+// retry (a network blip, a cloud API timeout or throttling response) as
+// opposed to a permanent error such as a malformed group selector.
+func isTransientResolveError(err error) bool {
+	type temporary interface {
+		Temporary() bool
+	}
+
+	if terr, ok := err.(temporary); ok {
+		return terr.Temporary()
+	}
+
+	// Without more specific information from the provider, assume
+	// resolution errors are transient so a single bad poll of a cloud API
+	// does not permanently blackhole a CNP's egress.
+	return true
+}